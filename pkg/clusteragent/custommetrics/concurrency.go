@@ -0,0 +1,242 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultMaxCASRetries = 5
+	casBaseBackoff       = 100 * time.Millisecond
+	casMaxBackoff        = 2 * time.Second
+)
+
+var (
+	casConflicts = telemetry.NewCounter("external_metrics_provider", "store_cas_conflicts",
+		nil, "Number of resourceVersion conflicts hit while persisting custom/external metrics")
+	casRetries = telemetry.NewCounter("external_metrics_provider", "store_cas_retries",
+		nil, "Number of read-modify-write retries performed after a resourceVersion conflict")
+)
+
+func maxCASRetries() int {
+	if n := config.Datadog.GetInt("external_metrics_provider.max_update_retries"); n > 0 {
+		return n
+	}
+	return defaultMaxCASRetries
+}
+
+// withCAS retries attempt, an optimistic-concurrency read-modify-write cycle, with capped
+// exponential backoff whenever it reports a resourceVersion conflict. attempt returns
+// (done=true, nil) on success, (false, nil) to signal "conflict, try again", and any other
+// error to abort immediately without retrying.
+func withCAS(attempt func() (done bool, err error)) error {
+	maxRetries := maxCASRetries()
+	backoff := casBaseBackoff
+	for i := 0; i <= maxRetries; i++ {
+		done, err := attempt()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		casConflicts.Inc()
+		if i == maxRetries {
+			break
+		}
+		casRetries.Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > casMaxBackoff {
+			backoff = casMaxBackoff
+		}
+	}
+	return fmt.Errorf("gave up persisting custom/external metrics after %d resourceVersion conflicts", maxRetries+1)
+}
+
+// Transaction batches several Set*/Delete calls so a Store can apply them as a single
+// read-modify-write/CAS attempt instead of one per call.
+type Transaction interface {
+	SetExternalMetricValues([]ExternalMetricValue) error
+	SetPodsMetrics([]PodsMetricDescriptor) error
+	SetObjectMetrics([]ObjectMetricDescriptor) error
+	Delete([]ObjectReference) error
+}
+
+// txOp is one queued mutation. apply patches an in-memory data map directly, for stores that
+// can fold every queued mutation into a single CAS attempt against one backing object. replay
+// re-issues the original call against a Store, for stores (sharded ConfigMaps, the CRD store)
+// where a single queued mutation can't be reduced to one object's CAS loop.
+type txOp struct {
+	apply  func(data map[string]string)
+	replay func(s Store) error
+}
+
+// pendingTransaction is the default Transaction implementation: it just records what was
+// asked for so the Store can decide how to apply it.
+//
+// Its Set* calls always return nil: callers routinely chain them as
+// `if err := tx.SetX(...); err != nil { return err }; return tx.SetY(...)`, and a schema
+// rejection on one call must not skip the others. Per-entry validation failures are instead
+// accumulated in errs and surfaced by the Store driver's Transaction method once the whole
+// closure has run, alongside the skipped entries' siblings that were still persisted.
+type pendingTransaction struct {
+	ops  []txOp
+	errs []error
+}
+
+func (t *pendingTransaction) SetExternalMetricValues(added []ExternalMetricValue) error {
+	if len(added) == 0 {
+		return nil
+	}
+	valid := make([]ExternalMetricValue, 0, len(added))
+	for _, m := range added {
+		if err := validateEntry(kindExternal, m); err != nil {
+			t.errs = append(t.errs, err)
+			continue
+		}
+		valid = append(valid, m)
+	}
+	if len(valid) > 0 {
+		t.ops = append(t.ops, txOp{
+			apply: func(data map[string]string) {
+				for _, m := range valid {
+					setEntryData(data, metadataFor(kindExternal, m.HPA, m.MetricName), m)
+				}
+			},
+			replay: func(s Store) error { return s.SetExternalMetricValues(valid) },
+		})
+	}
+	return nil
+}
+
+func (t *pendingTransaction) SetPodsMetrics(descs []PodsMetricDescriptor) error {
+	if len(descs) == 0 {
+		return nil
+	}
+	valid := make([]PodsMetricDescriptor, 0, len(descs))
+	for _, desc := range descs {
+		if err := validateEntry(kindPods, desc); err != nil {
+			t.errs = append(t.errs, err)
+			continue
+		}
+		valid = append(valid, desc)
+	}
+	if len(valid) > 0 {
+		t.ops = append(t.ops, txOp{
+			apply: func(data map[string]string) {
+				for _, desc := range valid {
+					setEntryData(data, metadataFor(kindPods, desc.HPA, desc.MetricName), desc)
+				}
+			},
+			replay: func(s Store) error { return s.SetPodsMetrics(valid) },
+		})
+	}
+	return nil
+}
+
+func (t *pendingTransaction) SetObjectMetrics(descs []ObjectMetricDescriptor) error {
+	if len(descs) == 0 {
+		return nil
+	}
+	valid := make([]ObjectMetricDescriptor, 0, len(descs))
+	for _, desc := range descs {
+		if err := validateEntry(kindObject, desc); err != nil {
+			t.errs = append(t.errs, err)
+			continue
+		}
+		valid = append(valid, desc)
+	}
+	if len(valid) > 0 {
+		t.ops = append(t.ops, txOp{
+			apply: func(data map[string]string) {
+				for _, desc := range valid {
+					setEntryData(data, metadataFor(kindObject, desc.HPA, desc.MetricName), desc)
+				}
+			},
+			replay: func(s Store) error { return s.SetObjectMetrics(valid) },
+		})
+	}
+	return nil
+}
+
+func (t *pendingTransaction) Delete(deleted []ObjectReference) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	t.ops = append(t.ops, txOp{
+		apply: func(data map[string]string) {
+			for _, obj := range deleted {
+				deleteEntryData(data, obj)
+			}
+		},
+		replay: func(s Store) error { return s.Delete(deleted) },
+	})
+	return nil
+}
+
+// applyAll runs every queued op's apply function against data, for stores backed by a single
+// object that can fold the whole transaction into one CAS attempt.
+func (t *pendingTransaction) applyAll(data map[string]string) {
+	for _, op := range t.ops {
+		op.apply(data)
+	}
+}
+
+// replayAll re-issues every queued op sequentially against s, for stores that can't reduce a
+// transaction to a single object's CAS loop.
+func (t *pendingTransaction) replayAll(s Store) error {
+	for _, op := range t.ops {
+		if err := op.replay(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setEntryData(data map[string]string, meta entryMetadata, obj interface{}) {
+	toStore, err := marshalEntry(meta, obj)
+	if err != nil {
+		log.Debugf("Could not marshal entry %v: %s", meta, err)
+		return
+	}
+	data[entryKey(meta.Kind, meta.HPAUID, meta.MetricNameHash)] = toStore
+}
+
+func deleteEntryData(data map[string]string, obj ObjectReference) {
+	selector := hpaUIDSelector(obj.UID)
+	for k, v := range data {
+		if _, ok := decodeStoredEntry(v, selector); ok {
+			delete(data, k)
+			log.Debugf("Deleted metric %s for HPA %s", k, obj.Name)
+		}
+	}
+}
+
+func marshalEntry(meta entryMetadata, obj interface{}) (string, error) {
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	toStore, err := json.Marshal(storedEntry{Meta: meta, Payload: payload})
+	if err != nil {
+		return "", err
+	}
+	return string(toStore), nil
+}
+
+func hpaUIDSelector(uid string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{labelOwner: ownerDatadogAgent, labelHPAUID: uid})
+}
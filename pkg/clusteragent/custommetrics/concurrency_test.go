@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestConfigMapStoreTransactionRetriesOnConflict(t *testing.T) {
+	config.Datadog.Set("external_metrics_provider.max_update_retries", 2)
+	defer config.Datadog.Set("external_metrics_provider.max_update_retries", 0)
+
+	client := fake.NewSimpleClientset()
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "datadog-custom-metrics", nil)
+		}
+		return false, nil, nil
+	})
+
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetExternalMetricValues([]ExternalMetricValue{
+		{MetricName: "rps", Value: 1, HPA: ObjectReference{UID: "uid-1", Namespace: "default", Name: "my-hpa"}},
+	}))
+	assert.Equal(t, 2, updates)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+}
+
+func TestWithCASGivesUpAfterMaxRetries(t *testing.T) {
+	config.Datadog.Set("external_metrics_provider.max_update_retries", 1)
+	defer config.Datadog.Set("external_metrics_provider.max_update_retries", 0)
+
+	var attempts int
+	err := withCAS(func() (bool, error) {
+		attempts++
+		return false, nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestTransactionBatchesIntoASingleUpdate(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return false, nil, nil
+	})
+
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	cms, ok := store.(*configMapStore)
+	require.True(t, ok)
+	err = cms.Transaction(func(tx Transaction) error {
+		if err := tx.SetExternalMetricValues([]ExternalMetricValue{
+			{MetricName: "rps", Value: 1, HPA: ObjectReference{UID: "uid-2", Namespace: "default", Name: "my-hpa"}},
+		}); err != nil {
+			return err
+		}
+		return tx.SetPodsMetrics([]PodsMetricDescriptor{
+			{MetricName: "queue_depth", HPA: ObjectReference{UID: "uid-2", Namespace: "default", Name: "my-hpa"}},
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, updates)
+
+	got, err := store.ListByHPA("default", "my-hpa")
+	require.NoError(t, err)
+	assert.Len(t, got.External, 1)
+	assert.Len(t, got.Pods, 1)
+}
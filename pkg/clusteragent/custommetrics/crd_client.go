@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+var datadogMetricSchemeGroupVersion = schema.GroupVersion{Group: datadogMetricGroup, Version: datadogMetricVersion}
+
+func addDatadogMetricTypes(s *runtime.Scheme) error {
+	s.AddKnownTypes(datadogMetricSchemeGroupVersion, &DatadogMetric{}, &DatadogMetricList{})
+	metav1.AddToGroupVersion(s, datadogMetricSchemeGroupVersion)
+	return nil
+}
+
+// datadogMetricRESTClient is a hand-rolled typed client for the DatadogMetric CRD. It exists so
+// customResourceStore doesn't have to depend on a generated clientset that this package's
+// vendor tree doesn't ship.
+type datadogMetricRESTClient struct {
+	client rest.Interface
+}
+
+// newDatadogMetricRESTClient builds a REST client scoped to the DatadogMetric CRD's
+// GroupVersion from the Cluster Agent's own Kubernetes client config.
+func newDatadogMetricRESTClient(cfg *rest.Config) (*datadogMetricRESTClient, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("external_metrics_provider.store_type=crd requires a rest.Config")
+	}
+
+	schemeBuilder := runtime.NewSchemeBuilder(addDatadogMetricTypes)
+	if err := schemeBuilder.AddToScheme(scheme.Scheme); err != nil {
+		return nil, err
+	}
+
+	crdConfig := *cfg
+	crdConfig.GroupVersion = &datadogMetricSchemeGroupVersion
+	crdConfig.APIPath = "/apis"
+	crdConfig.NegotiatedSerializer = serializer.NewCodecFactory(scheme.Scheme).WithoutConversion()
+	crdConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	client, err := rest.RESTClientFor(&crdConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &datadogMetricRESTClient{client: client}, nil
+}
+
+func (c *datadogMetricRESTClient) list(ns string) (*DatadogMetricList, error) {
+	return c.listBySelector(ns, labels.Everything())
+}
+
+// listBySelector lists DatadogMetric objects matching selector. Since each metric is its own
+// object with real labels (unlike the ConfigMap/Secret stores' data entries), this is a plain
+// server-side label-selector list.
+func (c *datadogMetricRESTClient) listBySelector(ns string, selector labels.Selector) (*DatadogMetricList, error) {
+	result := &DatadogMetricList{}
+	err := c.client.Get().
+		Namespace(ns).
+		Resource(datadogMetricResource).
+		VersionedParams(&metav1.ListOptions{LabelSelector: selector.String()}, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *datadogMetricRESTClient) upsert(ns string, dm *DatadogMetric) (*DatadogMetric, error) {
+	existing := &DatadogMetric{}
+	err := c.client.Get().Namespace(ns).Resource(datadogMetricResource).Name(dm.Name).Do().Into(existing)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		result := &DatadogMetric{}
+		createErr := c.client.Post().Namespace(ns).Resource(datadogMetricResource).Body(dm).Do().Into(result)
+		return result, createErr
+	}
+
+	dm.ResourceVersion = existing.ResourceVersion
+	result := &DatadogMetric{}
+	updateErr := c.client.Put().Namespace(ns).Resource(datadogMetricResource).Name(dm.Name).Body(dm).Do().Into(result)
+	return result, updateErr
+}
+
+func (c *datadogMetricRESTClient) delete(ns, name string) error {
+	return c.client.Delete().Namespace(ns).Resource(datadogMetricResource).Name(name).Do().Error()
+}
@@ -0,0 +1,218 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+)
+
+// customResourceStore provides persistent storage of custom and external metrics, one
+// DatadogMetric object per metric, so that users can `kubectl get` an individual metric
+// instead of grepping through a ConfigMap or Secret. Unlike those two, each metric is a real
+// Kubernetes object, so its indexing metadata is carried as real object labels rather than
+// bolted onto the payload.
+type customResourceStore struct {
+	namespace string
+	client    *datadogMetricRESTClient
+}
+
+// NewCustomResourceStore returns a new store backed by the DatadogMetric CRD. `cfg` is the
+// Cluster Agent's own Kubernetes client config, used to build a REST client scoped to the
+// CRD's GroupVersion.
+func NewCustomResourceStore(cfg *rest.Config, ns string) (Store, error) {
+	client, err := newDatadogMetricRESTClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &customResourceStore{
+		namespace: ns,
+		client:    client,
+	}, nil
+}
+
+func (c *customResourceStore) SetExternalMetricValues(added []ExternalMetricValue) error {
+	var errs []error
+	for _, m := range added {
+		if err := validateEntry(kindExternal, m); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindExternal, m.HPA, m.MetricName)
+		dm := &DatadogMetric{
+			ObjectMeta: metav1.ObjectMeta{Name: datadogMetricName(meta), Labels: meta.Labels()},
+			Spec:       DatadogMetricSpec{ExternalValue: &m},
+		}
+		if err := c.upsertWithRetry(dm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func (c *customResourceStore) SetPodsMetrics(descs []PodsMetricDescriptor) error {
+	var errs []error
+	for _, desc := range descs {
+		if err := validateEntry(kindPods, desc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindPods, desc.HPA, desc.MetricName)
+		dm := &DatadogMetric{
+			ObjectMeta: metav1.ObjectMeta{Name: datadogMetricName(meta), Labels: meta.Labels()},
+			Spec:       DatadogMetricSpec{PodsMetric: &desc},
+		}
+		if err := c.upsertWithRetry(dm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func (c *customResourceStore) SetObjectMetrics(descs []ObjectMetricDescriptor) error {
+	var errs []error
+	for _, desc := range descs {
+		if err := validateEntry(kindObject, desc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindObject, desc.HPA, desc.MetricName)
+		dm := &DatadogMetric{
+			ObjectMeta: metav1.ObjectMeta{Name: datadogMetricName(meta), Labels: meta.Labels()},
+			Spec:       DatadogMetricSpec{ObjectMetric: &desc},
+		}
+		if err := c.upsertWithRetry(dm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// upsertWithRetry upserts dm, retrying through withCAS if the Put races another writer's
+// update of the same DatadogMetric between our Get and our Put.
+func (c *customResourceStore) upsertWithRetry(dm *DatadogMetric) error {
+	return withCAS(func() (bool, error) {
+		_, err := c.client.upsert(c.namespace, dm)
+		if err == nil {
+			return true, nil
+		}
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	})
+}
+
+// Delete deletes all DatadogMetric objects that refer to any of the given object references. A
+// list or delete failure for one object's DatadogMetrics doesn't stop the rest of the batch
+// from being attempted; every failure is combined into the returned error.
+func (c *customResourceStore) Delete(deleted []ObjectReference) error {
+	var errs []error
+	for _, obj := range deleted {
+		selector := hpaUIDSelector(obj.UID)
+		list, err := c.client.listBySelector(c.namespace, selector)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, dm := range list.Items {
+			if err := c.deleteWithRetry(dm.Name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return combineErrors(errs)
+}
+
+// deleteWithRetry deletes the named DatadogMetric, retrying through withCAS if the delete races
+// another writer's update of the same object between our list and our delete. A NotFound is
+// treated as success: the object is already gone.
+func (c *customResourceStore) deleteWithRetry(name string) error {
+	return withCAS(func() (bool, error) {
+		err := c.client.delete(c.namespace, name)
+		if err == nil || errors.IsNotFound(err) {
+			return true, nil
+		}
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	})
+}
+
+// Transaction replays fn's mutations sequentially: each DatadogMetric is its own object, so a
+// transaction can't be folded into a single CAS attempt the way configMapStore and secretStore
+// fold theirs into one ConfigMap/Secret update. txn.errs is combined into the result alongside
+// any replay error, same as every other Store driver.
+func (c *customResourceStore) Transaction(fn func(tx Transaction) error) error {
+	txn := &pendingTransaction{}
+	fnErr := fn(txn)
+	replayErr := txn.replayAll(c)
+	return combineErrors(append(txn.errs, fnErr, replayErr))
+}
+
+// Schemas returns the JSON schema currently validated against for each metric kind.
+func (c *customResourceStore) Schemas() map[string]string {
+	return defaultSchemaRegistry.Schemas()
+}
+
+func (c *customResourceStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
+	metrics, _, _, err := c.listAll()
+	return metrics, err
+}
+
+func (c *customResourceStore) ListAllPodsMetrics() ([]PodsMetricDescriptor, error) {
+	_, pods, _, err := c.listAll()
+	return pods, err
+}
+
+func (c *customResourceStore) ListAllObjectMetrics() ([]ObjectMetricDescriptor, error) {
+	_, _, object, err := c.listAll()
+	return object, err
+}
+
+// ListByHPA resolves every metric stored for a single HPA via a server-side label-selector list.
+func (c *customResourceStore) ListByHPA(namespace, name string) (HPAMetrics, error) {
+	return c.ListByLabels(hpaSelector(namespace, name))
+}
+
+// ListByLabels returns every metric whose object labels match selector.
+func (c *customResourceStore) ListByLabels(selector labels.Selector) (HPAMetrics, error) {
+	list, err := c.client.listBySelector(c.namespace, selector)
+	if err != nil {
+		return HPAMetrics{}, err
+	}
+	var out HPAMetrics
+	for _, dm := range list.Items {
+		switch {
+		case dm.Spec.ExternalValue != nil:
+			out.External = append(out.External, *dm.Spec.ExternalValue)
+		case dm.Spec.PodsMetric != nil:
+			out.Pods = append(out.Pods, *dm.Spec.PodsMetric)
+		case dm.Spec.ObjectMetric != nil:
+			out.Object = append(out.Object, *dm.Spec.ObjectMetric)
+		}
+	}
+	return out, nil
+}
+
+func (c *customResourceStore) listAll() ([]ExternalMetricValue, []PodsMetricDescriptor, []ObjectMetricDescriptor, error) {
+	out, err := c.ListByLabels(labels.SelectorFromSet(labels.Set{labelOwner: ownerDatadogAgent}))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out.External, out.Pods, out.Object, nil
+}
+
+// datadogMetricName derives a valid, stable DNS subdomain name for the DatadogMetric backing a
+// given entry.
+func datadogMetricName(meta entryMetadata) string {
+	return meta.Kind + "-" + meta.HPAUID + "-" + meta.MetricNameHash
+}
@@ -0,0 +1,179 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeDatadogMetricAPIServer is a minimal in-memory stand-in for the apiserver endpoints
+// datadogMetricRESTClient talks to: Get/Post/Put/Delete of a single DatadogMetric by name, and
+// a selector-less List of everything stored so far. It ignores label selectors, so a List
+// returns every stored object; the Delete tests below store only objects for which that gives
+// the same outcome as a server-side filtered List.
+type fakeDatadogMetricAPIServer struct {
+	mu             sync.Mutex
+	items          map[string]*DatadogMetric
+	failDeleteName string
+}
+
+func newFakeDatadogMetricAPIServer() (*httptest.Server, *fakeDatadogMetricAPIServer) {
+	s := &fakeDatadogMetricAPIServer{items: make(map[string]*DatadogMetric)}
+	return httptest.NewServer(http.HandlerFunc(s.handle)), s
+}
+
+func (s *fakeDatadogMetricAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/apis/datadoghq.com/v1alpha1/namespaces/default/datadogmetrics"
+	name := ""
+	if len(r.URL.Path) > len(prefix)+1 && r.URL.Path[:len(prefix)] == prefix {
+		name = r.URL.Path[len(prefix)+1:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			list := &DatadogMetricList{}
+			for _, dm := range s.items {
+				list.Items = append(list.Items, *dm)
+			}
+			writeJSON(w, http.StatusOK, list)
+			return
+		}
+		dm, ok := s.items[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, &metav1.Status{
+				Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, dm)
+	case http.MethodPost:
+		dm := &DatadogMetric{}
+		json.NewDecoder(r.Body).Decode(dm)
+		dm.ResourceVersion = "1"
+		s.items[dm.Name] = dm
+		writeJSON(w, http.StatusCreated, dm)
+	case http.MethodPut:
+		dm := &DatadogMetric{}
+		json.NewDecoder(r.Body).Decode(dm)
+		dm.ResourceVersion = fmt.Sprintf("%s-updated", dm.ResourceVersion)
+		s.items[name] = dm
+		writeJSON(w, http.StatusOK, dm)
+	case http.MethodDelete:
+		if name == s.failDeleteName {
+			writeJSON(w, http.StatusInternalServerError, &metav1.Status{
+				Status: metav1.StatusFailure, Reason: metav1.StatusReasonInternalError, Code: http.StatusInternalServerError,
+			})
+			return
+		}
+		delete(s.items, name)
+		writeJSON(w, http.StatusOK, &metav1.Status{Status: metav1.StatusSuccess})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func newTestCustomResourceStore(t *testing.T, serverURL string) Store {
+	store, err := NewCustomResourceStore(&rest.Config{Host: serverURL}, "default")
+	require.NoError(t, err)
+	return store
+}
+
+func TestCustomResourceStoreUpsertCreatesWhenNotFound(t *testing.T) {
+	server, _ := newFakeDatadogMetricAPIServer()
+	defer server.Close()
+	store := newTestCustomResourceStore(t, server.URL)
+
+	ref := ObjectReference{UID: "uid-1", Namespace: "default", Name: "my-hpa"}
+	require.NoError(t, store.SetExternalMetricValues([]ExternalMetricValue{
+		{MetricName: "rps", Value: 42, HPA: ref},
+	}))
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "rps", metrics[0].MetricName)
+}
+
+func TestCustomResourceStoreUpsertUpdatesWhenFound(t *testing.T) {
+	server, _ := newFakeDatadogMetricAPIServer()
+	defer server.Close()
+	store := newTestCustomResourceStore(t, server.URL)
+
+	ref := ObjectReference{UID: "uid-2", Namespace: "default", Name: "my-hpa"}
+	require.NoError(t, store.SetExternalMetricValues([]ExternalMetricValue{{MetricName: "rps", Value: 1, HPA: ref}}))
+	require.NoError(t, store.SetExternalMetricValues([]ExternalMetricValue{{MetricName: "rps", Value: 2, HPA: ref}}))
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(2), metrics[0].Value)
+}
+
+func TestCustomResourceStoreDelete(t *testing.T) {
+	server, _ := newFakeDatadogMetricAPIServer()
+	defer server.Close()
+	store := newTestCustomResourceStore(t, server.URL)
+
+	ref := ObjectReference{UID: "uid-3", Namespace: "default", Name: "my-hpa"}
+	require.NoError(t, store.SetObjectMetrics([]ObjectMetricDescriptor{{MetricName: "backlog", HPA: ref}}))
+	require.NoError(t, store.Delete([]ObjectReference{ref}))
+
+	descs, err := store.ListAllObjectMetrics()
+	require.NoError(t, err)
+	assert.Empty(t, descs)
+}
+
+func TestCustomResourceStoreDeletePartialFailureDeletesTheRest(t *testing.T) {
+	server, fake := newFakeDatadogMetricAPIServer()
+	defer server.Close()
+	store := newTestCustomResourceStore(t, server.URL)
+
+	ref1 := ObjectReference{UID: "uid-5", Namespace: "default", Name: "hpa-one"}
+	ref2 := ObjectReference{UID: "uid-6", Namespace: "default", Name: "hpa-two"}
+	require.NoError(t, store.SetObjectMetrics([]ObjectMetricDescriptor{{MetricName: "backlog", HPA: ref1}}))
+	require.NoError(t, store.SetObjectMetrics([]ObjectMetricDescriptor{{MetricName: "queue_depth", HPA: ref2}}))
+
+	fake.failDeleteName = datadogMetricName(metadataFor(kindObject, ref1, "backlog"))
+
+	err := store.Delete([]ObjectReference{ref1, ref2})
+	require.Error(t, err)
+
+	descs, err := store.ListAllObjectMetrics()
+	require.NoError(t, err)
+	require.Len(t, descs, 1)
+	assert.Equal(t, "backlog", descs[0].MetricName)
+}
+
+func TestDatadogMetricName(t *testing.T) {
+	meta := metadataFor(kindExternal, ObjectReference{UID: "uid-4"}, "requests_per_second")
+	name := datadogMetricName(meta)
+	assert.Equal(t, meta.Kind+"-"+meta.HPAUID+"-"+meta.MetricNameHash, name)
+}
+
+func TestNewCustomResourceStoreRequiresConfig(t *testing.T) {
+	_, err := NewCustomResourceStore(nil, "default")
+	require.Error(t, err)
+}
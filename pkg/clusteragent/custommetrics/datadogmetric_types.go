@@ -0,0 +1,97 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	datadogMetricGroup    = "datadoghq.com"
+	datadogMetricVersion  = "v1alpha1"
+	datadogMetricKind     = "DatadogMetric"
+	datadogMetricResource = "datadogmetrics"
+)
+
+// datadogMetricGVR is the GroupVersionResource served by the DatadogMetric CRD, backing the
+// "crd" external_metrics_provider.store_type.
+var datadogMetricGVR = schema.GroupVersionResource{
+	Group:    datadogMetricGroup,
+	Version:  datadogMetricVersion,
+	Resource: datadogMetricResource,
+}
+
+// DatadogMetric stores a single custom or external metric as its own Kubernetes object, so
+// operators can `kubectl get datadogmetrics` to inspect individual values without the
+// ConfigMap/Secret stores' 1MB object size limit.
+type DatadogMetric struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DatadogMetricSpec `json:"spec"`
+}
+
+// DatadogMetricSpec holds the payload of exactly one of ExternalValue, PodsMetric or ObjectMetric,
+// mirroring the three kinds the Store interface already distinguishes.
+type DatadogMetricSpec struct {
+	ExternalValue *ExternalMetricValue    `json:"externalValue,omitempty"`
+	PodsMetric    *PodsMetricDescriptor   `json:"podsMetric,omitempty"`
+	ObjectMetric  *ObjectMetricDescriptor `json:"objectMetric,omitempty"`
+}
+
+// DatadogMetricList is a list of DatadogMetric.
+type DatadogMetricList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []DatadogMetric `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (d *DatadogMetric) DeepCopyObject() runtime.Object {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	out.ObjectMeta = *d.ObjectMeta.DeepCopy()
+	out.Spec = d.Spec.deepCopy()
+	return &out
+}
+
+func (s DatadogMetricSpec) deepCopy() DatadogMetricSpec {
+	out := s
+	if s.ExternalValue != nil {
+		v := *s.ExternalValue
+		out.ExternalValue = &v
+	}
+	if s.PodsMetric != nil {
+		v := *s.PodsMetric
+		out.PodsMetric = &v
+	}
+	if s.ObjectMetric != nil {
+		v := *s.ObjectMetric
+		out.ObjectMetric = &v
+	}
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (l *DatadogMetricList) DeepCopyObject() runtime.Object {
+	if l == nil {
+		return nil
+	}
+	out := *l
+	out.Items = make([]DatadogMetric, len(l.Items))
+	for i := range l.Items {
+		item := l.Items[i]
+		out.Items[i] = *item.DeepCopyObject().(*DatadogMetric)
+	}
+	return &out
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Labels used to index stored entries: every entry carries enough metadata to be resolved by
+// owner without parsing its storage key.
+const (
+	labelOwner          = "owner"
+	labelKind           = "kind"
+	labelHPAUID         = "hpa-uid"
+	labelHPANamespace   = "hpa-namespace"
+	labelHPAName        = "hpa-name"
+	labelMetricNameHash = "metric-name-hash"
+
+	ownerDatadogAgent = "datadog-agent"
+
+	kindExternal = "external"
+	kindPods     = "pods"
+	kindObject   = "object"
+)
+
+// HPAMetrics groups every metric kind stored for a single HPA, returned by ListByHPA so
+// callers don't need three separate label-selector lookups.
+type HPAMetrics struct {
+	External []ExternalMetricValue
+	Pods     []PodsMetricDescriptor
+	Object   []ObjectMetricDescriptor
+}
+
+// entryMetadata is the indexing information kept alongside every stored metric. It is
+// serialized into the entry itself (ConfigMap/Secret data values aren't individually
+// labelable) and surfaced as a labels.Set so ListByHPA/ListByLabels and Delete can select
+// entries without string-splitting the storage key.
+type entryMetadata struct {
+	Kind           string `json:"kind"`
+	HPAUID         string `json:"hpaUID"`
+	HPANamespace   string `json:"hpaNamespace"`
+	HPAName        string `json:"hpaName"`
+	MetricNameHash string `json:"metricNameHash"`
+}
+
+// storedEntry wraps a metric payload with the metadata needed to index it.
+type storedEntry struct {
+	Meta    entryMetadata   `json:"meta"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func metadataFor(kind string, hpa ObjectReference, metricName string) entryMetadata {
+	return entryMetadata{
+		Kind:           kind,
+		HPAUID:         hpa.UID,
+		HPANamespace:   hpa.Namespace,
+		HPAName:        hpa.Name,
+		MetricNameHash: hashMetricName(metricName),
+	}
+}
+
+// Labels exposes the entry's metadata as a labels.Set so it can be matched against a
+// labels.Selector, the same way a real Kubernetes object's labels would be.
+func (m entryMetadata) Labels() labels.Set {
+	return labels.Set{
+		labelOwner:          ownerDatadogAgent,
+		labelKind:           m.Kind,
+		labelHPAUID:         m.HPAUID,
+		labelHPANamespace:   m.HPANamespace,
+		labelHPAName:        m.HPAName,
+		labelMetricNameHash: m.MetricNameHash,
+	}
+}
+
+func hpaSelector(namespace, name string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{
+		labelOwner:        ownerDatadogAgent,
+		labelHPANamespace: namespace,
+		labelHPAName:      name,
+	})
+}
+
+// hashMetricName returns a short, label-value-safe hash of a metric name, which may otherwise
+// contain characters (e.g. "nginx.net/requests") that aren't valid label values.
+func hashMetricName(metricName string) string {
+	sum := sha256.Sum256([]byte(metricName))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// entryKey returns the opaque storage key for an entry, derived from its already-hashed
+// metadata. Unlike the legacy "<kind>-<uid>-<name>" scheme, it carries no parseable
+// structure: all indexing goes through the entry's metadata instead.
+func entryKey(kind, hpaUID, metricNameHash string) string {
+	sum := sha256.Sum256([]byte(kind + "/" + hpaUID + "/" + metricNameHash))
+	return fmt.Sprintf("%x", sum)
+}
+
+// decodeStoredEntry unmarshals a storage value and checks it against selector, returning ok=false
+// if it doesn't match or isn't decodable (e.g. a legacy, pre-migration value).
+func decodeStoredEntry(raw string, selector labels.Selector) (storedEntry, bool) {
+	var entry storedEntry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return storedEntry{}, false
+	}
+	if entry.Meta.Kind == "" || !selector.Matches(entry.Meta.Labels()) {
+		return storedEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,40 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import "time"
+
+// ObjectReference references a Kubernetes object that owns one or more custom/external metrics,
+// typically a HorizontalPodAutoscaler.
+type ObjectReference struct {
+	UID       string
+	Namespace string
+	Name      string
+}
+
+// ExternalMetricValue holds the value of an external metric as resolved for a given HPA.
+type ExternalMetricValue struct {
+	MetricName string
+	Labels     map[string]string
+	Value      float64
+	Timestamp  time.Time
+	HPA        ObjectReference
+	Valid      bool
+}
+
+// PodsMetricDescriptor describes a pods-type metric referenced by an HPA.
+type PodsMetricDescriptor struct {
+	MetricName string
+	HPA        ObjectReference
+}
+
+// ObjectMetricDescriptor describes an object-type metric referenced by an HPA.
+type ObjectMetricDescriptor struct {
+	MetricName string
+	HPA        ObjectReference
+}
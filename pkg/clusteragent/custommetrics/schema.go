@@ -0,0 +1,264 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"github.com/xeipuuv/gojsonschema"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// externalMetricValueSchema is the default JSON schema for ExternalMetricValue. It requires a
+// non-empty MetricName and HPA.UID (so a malformed descriptor can never be stored without an
+// owner to blame), rejects negative values, and requires Timestamp, when set, to be a
+// well-formed RFC 3339 date-time rather than whatever the HPA-supplied source happened to emit.
+const externalMetricValueSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "ExternalMetricValue",
+  "type": "object",
+  "required": ["MetricName", "HPA"],
+  "properties": {
+    "MetricName": {"type": "string", "minLength": 1},
+    "Value": {"type": "number", "minimum": 0},
+    "Timestamp": {"type": "string", "format": "date-time"},
+    "HPA": {"$ref": "#/definitions/objectReference"}
+  },
+  "definitions": {
+    "objectReference": {
+      "type": "object",
+      "required": ["UID"],
+      "properties": {
+        "UID": {"type": "string", "minLength": 1}
+      }
+    }
+  }
+}`
+
+// podsMetricDescriptorSchema is the default JSON schema for PodsMetricDescriptor.
+const podsMetricDescriptorSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "PodsMetricDescriptor",
+  "type": "object",
+  "required": ["MetricName", "HPA"],
+  "properties": {
+    "MetricName": {"type": "string", "minLength": 1},
+    "HPA": {
+      "type": "object",
+      "required": ["UID"],
+      "properties": {
+        "UID": {"type": "string", "minLength": 1}
+      }
+    }
+  }
+}`
+
+// objectMetricDescriptorSchema is the default JSON schema for ObjectMetricDescriptor.
+const objectMetricDescriptorSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "ObjectMetricDescriptor",
+  "type": "object",
+  "required": ["MetricName", "HPA"],
+  "properties": {
+    "MetricName": {"type": "string", "minLength": 1},
+    "HPA": {
+      "type": "object",
+      "required": ["UID"],
+      "properties": {
+        "UID": {"type": "string", "minLength": 1}
+      }
+    }
+  }
+}`
+
+// defaultSchemaConfigMapName is the ConfigMap consulted for tenant-specific schema overrides,
+// overridable via `external_metrics_provider.schema_configmap_name`.
+const defaultSchemaConfigMapName = "datadog-custom-metrics-schemas"
+
+// ValidationError is returned when an object fails schema validation, carrying enough context
+// (kind, HPA reference, the raw schema violations) for the autoscaler controller to surface it
+// as an HPA event instead of just logging it.
+type ValidationError struct {
+	Kind       string
+	MetricName string
+	HPA        ObjectReference
+	Errors     []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("metric %q (kind=%s, hpa=%s/%s) failed schema validation: %s",
+		e.MetricName, e.Kind, e.HPA.Namespace, e.HPA.Name, strings.Join(e.Errors, "; "))
+}
+
+// compiledSchema pairs a schema's raw JSON (returned by Schemas() for clients to read) with its
+// compiled form, so validate doesn't re-parse the schema document on every single Set* call.
+type compiledSchema struct {
+	raw      string
+	compiled *gojsonschema.Schema
+}
+
+// schemaRegistry holds, per metric kind, the JSON schema that Set* calls are validated against
+// before persisting. It starts out seeded with the built-in schemas above and can have any of
+// them replaced at runtime via SetOverride, the way ApplySchemaOverrides does from a ConfigMap.
+type schemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*compiledSchema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	r := &schemaRegistry{schemas: make(map[string]*compiledSchema)}
+	defaults := map[string]string{
+		kindExternal: externalMetricValueSchema,
+		kindPods:     podsMetricDescriptorSchema,
+		kindObject:   objectMetricDescriptorSchema,
+	}
+	for kind, raw := range defaults {
+		compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(raw))
+		if err != nil {
+			panic(fmt.Sprintf("custommetrics: built-in schema for kind %q does not compile: %s", kind, err))
+		}
+		r.schemas[kind] = &compiledSchema{raw: raw, compiled: compiled}
+	}
+	return r
+}
+
+// defaultSchemaRegistry is the process-wide registry consulted by validateEntry. It's a
+// package-level singleton, rather than a field threaded through every Store, so that every
+// driver (and the external metrics API server advertising Schemas()) always sees the same
+// overrides once ApplySchemaOverrides has run.
+var defaultSchemaRegistry = newSchemaRegistry()
+
+// Schemas returns a copy of every schema currently in effect, keyed by kind.
+func (r *schemaRegistry) Schemas() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]string, len(r.schemas))
+	for k, v := range r.schemas {
+		out[k] = v.raw
+	}
+	return out
+}
+
+// SetOverride replaces the schema used for kind. It compiles schema first so a malformed
+// tenant-supplied override is rejected immediately instead of failing every Set* call it's
+// later used against, and so that later validate calls reuse the already-compiled schema.
+func (r *schemaRegistry) SetOverride(kind, schema string) error {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return fmt.Errorf("invalid schema override for kind %q: %s", kind, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[kind] = &compiledSchema{raw: schema, compiled: compiled}
+	return nil
+}
+
+// validate checks obj against the schema currently in effect for kind. An unregistered kind
+// validates successfully: it has nothing to check against.
+func (r *schemaRegistry) validate(kind string, obj interface{}) error {
+	r.mu.RLock()
+	s, ok := r.schemas[kind]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	result, err := s.compiled.Validate(gojsonschema.NewGoLoader(obj))
+	if err != nil {
+		return fmt.Errorf("could not validate %s metric against its schema: %s", kind, err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	errs := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	return newValidationError(kind, obj, errs)
+}
+
+// multiError joins several errors (e.g. one ValidationError per rejected entry in a batch) into
+// a single error, so a partially-invalid Set* call can report every rejection without hiding
+// that the rest of the batch still succeeded.
+type multiError struct {
+	errs []error
+}
+
+func (m *multiError) Error() string {
+	parts := make([]string, len(m.errs))
+	for i, err := range m.errs {
+		parts[i] = err.Error()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// combineErrors merges errs into a single error, dropping any nils. It returns nil if every
+// entry was nil, the lone error unwrapped if there was only one, or a *multiError otherwise.
+func combineErrors(errs []error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	default:
+		return &multiError{errs: nonNil}
+	}
+}
+
+// newValidationError builds the ValidationError for obj, pulling MetricName/HPA out of the
+// three concrete descriptor types so callers get a reference they can attribute the event to.
+func newValidationError(kind string, obj interface{}, errs []string) error {
+	switch v := obj.(type) {
+	case ExternalMetricValue:
+		return &ValidationError{Kind: kind, MetricName: v.MetricName, HPA: v.HPA, Errors: errs}
+	case PodsMetricDescriptor:
+		return &ValidationError{Kind: kind, MetricName: v.MetricName, HPA: v.HPA, Errors: errs}
+	case ObjectMetricDescriptor:
+		return &ValidationError{Kind: kind, MetricName: v.MetricName, HPA: v.HPA, Errors: errs}
+	default:
+		return &ValidationError{Kind: kind, Errors: errs}
+	}
+}
+
+// validateEntry validates obj against the schema currently registered for kind.
+func validateEntry(kind string, obj interface{}) error {
+	return defaultSchemaRegistry.validate(kind, obj)
+}
+
+// ApplySchemaOverrides reads the ConfigMap ns/name (NewStore passes
+// `external_metrics_provider.schema_configmap_name`, defaulting to
+// datadog-custom-metrics-schemas) and, if it exists, installs its "external"/"pods"/"object"
+// keys as schema overrides. A missing ConfigMap is not an error: clusters that don't need
+// stricter tenant-specific rules just keep the built-in schemas.
+func ApplySchemaOverrides(client kubernetes.Interface, ns, name string) error {
+	cm, err := client.CoreV1().ConfigMaps(ns).Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("No schema override configmap %s/%s: %s", ns, name, err)
+		return nil
+	}
+	for _, kind := range []string{kindExternal, kindPods, kindObject} {
+		schema, ok := cm.Data[kind]
+		if !ok {
+			continue
+		}
+		if err := defaultSchemaRegistry.SetOverride(kind, schema); err != nil {
+			return err
+		}
+		log.Infof("Applied a schema override for %s metrics from %s/%s", kind, ns, name)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestValidateEntryRejectsEmptyMetricName(t *testing.T) {
+	err := validateEntry(kindExternal, ExternalMetricValue{HPA: ObjectReference{UID: "uid-1"}})
+	require.Error(t, err)
+	verr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	assert.Equal(t, kindExternal, verr.Kind)
+}
+
+func TestValidateEntryRejectsMissingHPAUID(t *testing.T) {
+	err := validateEntry(kindPods, PodsMetricDescriptor{MetricName: "queue_depth"})
+	require.Error(t, err)
+}
+
+func TestValidateEntryRejectsNegativeValue(t *testing.T) {
+	err := validateEntry(kindExternal, ExternalMetricValue{
+		MetricName: "rps", Value: -1, HPA: ObjectReference{UID: "uid-2"},
+	})
+	require.Error(t, err)
+}
+
+func TestValidateEntryAcceptsWellFormedMetric(t *testing.T) {
+	err := validateEntry(kindObject, ObjectMetricDescriptor{
+		MetricName: "backlog", HPA: ObjectReference{UID: "uid-3", Namespace: "default", Name: "my-hpa"},
+	})
+	assert.NoError(t, err)
+}
+
+func TestConfigMapStoreRejectsInvalidMetricBeforeWriting(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	err = store.SetExternalMetricValues([]ExternalMetricValue{{MetricName: "", HPA: ObjectReference{UID: "uid-4"}}})
+	require.Error(t, err)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestConfigMapStorePersistsValidEntriesAlongsideRejectedOnes(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	err = store.SetExternalMetricValues([]ExternalMetricValue{
+		{MetricName: "", HPA: ObjectReference{UID: "uid-6"}},
+		{MetricName: "rps", Value: 1, HPA: ObjectReference{UID: "uid-7", Namespace: "default", Name: "my-hpa"}},
+	})
+	require.Error(t, err)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "rps", metrics[0].MetricName)
+}
+
+func TestApplySchemaOverrides(t *testing.T) {
+	defer func() { defaultSchemaRegistry = newSchemaRegistry() }()
+
+	client := fake.NewSimpleClientset()
+	_, err := client.CoreV1().ConfigMaps("default").Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "datadog-custom-metrics-schemas", Namespace: "default"},
+		Data: map[string]string{
+			kindPods: `{"type": "object", "required": ["MetricName", "HPA"], "properties": {"MetricName": {"type": "string", "pattern": "^tenant-"}}}`,
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, ApplySchemaOverrides(client, "default", "datadog-custom-metrics-schemas"))
+
+	assert.NoError(t, validateEntry(kindPods, PodsMetricDescriptor{MetricName: "tenant-queue_depth", HPA: ObjectReference{UID: "uid-5"}}))
+	assert.Error(t, validateEntry(kindPods, PodsMetricDescriptor{MetricName: "queue_depth", HPA: ObjectReference{UID: "uid-5"}}))
+}
+
+func TestApplySchemaOverridesMissingConfigMapIsNotAnError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	assert.NoError(t, ApplySchemaOverrides(client, "default", "datadog-custom-metrics-schemas"))
+}
+
+func TestSchemaRegistrySetOverrideRejectsMalformedSchema(t *testing.T) {
+	r := newSchemaRegistry()
+	err := r.SetOverride(kindExternal, `{"type": "nonsense-type"}`)
+	assert.Error(t, err)
+}
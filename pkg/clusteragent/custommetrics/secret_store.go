@@ -0,0 +1,271 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// secretStore provides persistent storage of custom and external metrics using a Secret.
+// It is otherwise identical to configMapStore: some clusters restrict RBAC so that the
+// Cluster Agent can only read/write Secrets, or consider metric values (e.g. business metrics
+// pulled in as external metrics) sensitive enough to warrant Secret-level access control.
+type secretStore struct {
+	namespace string
+	name      string
+	client    corev1.CoreV1Interface
+	secret    *v1.Secret
+}
+
+// NewSecretStore returns a new store backed by a Secret. The Secret will be created in the
+// specified namespace if it does not exist.
+func NewSecretStore(client kubernetes.Interface, ns, name string) (Store, error) {
+	secret, err := client.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if err == nil {
+		log.Infof("Retrieved the secret %s", name)
+		return &secretStore{
+			namespace: ns,
+			name:      name,
+			client:    client.CoreV1(),
+			secret:    secret,
+		}, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		log.Infof("Error while attempting to fetch the secret %s: %s", name, err)
+		return nil, err
+	}
+
+	log.Infof("The secret %s does not exist, trying to create it", name)
+	secret = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels:    map[string]string{labelOwner: ownerDatadogAgent},
+		},
+		Type: v1.SecretTypeOpaque,
+	}
+	// FIXME: distinguish RBAC error
+	secret, err = client.CoreV1().Secrets(ns).Create(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &secretStore{
+		namespace: ns,
+		name:      name,
+		client:    client.CoreV1(),
+		secret:    secret,
+	}, nil
+}
+
+// SetExternalMetricValues updates the external metrics in the secret.
+func (s *secretStore) SetExternalMetricValues(added []ExternalMetricValue) error {
+	return s.Transaction(func(tx Transaction) error { return tx.SetExternalMetricValues(added) })
+}
+
+func (s *secretStore) SetPodsMetrics(descs []PodsMetricDescriptor) error {
+	return s.Transaction(func(tx Transaction) error { return tx.SetPodsMetrics(descs) })
+}
+
+func (s *secretStore) SetObjectMetrics(descs []ObjectMetricDescriptor) error {
+	return s.Transaction(func(tx Transaction) error { return tx.SetObjectMetrics(descs) })
+}
+
+// Delete deletes all metrics in the secret that refer to any of the given object references.
+func (s *secretStore) Delete(deleted []ObjectReference) error {
+	return s.Transaction(func(tx Transaction) error { return tx.Delete(deleted) })
+}
+
+// Transaction performs fn's mutations as a single read-modify-write cycle against the secret,
+// retrying on a resourceVersion conflict the same way configMapStore.Transaction does. txn.errs
+// is combined into the result alongside any CAS error, same as every other Store driver.
+func (s *secretStore) Transaction(fn func(tx Transaction) error) error {
+	txn := &pendingTransaction{}
+	fnErr := fn(txn)
+	if len(txn.ops) == 0 {
+		return combineErrors(append(txn.errs, fnErr))
+	}
+	casErr := withCAS(func() (bool, error) {
+		if err := s.getSecret(); err != nil {
+			return false, err
+		}
+		secret := s.secret.DeepCopy()
+		data := make(map[string]string, len(secret.Data))
+		for k, v := range secret.Data {
+			data[k] = string(v)
+		}
+		txn.applyAll(data)
+		secret.Data = make(map[string][]byte, len(data))
+		for k, v := range data {
+			secret.Data[k] = []byte(v)
+		}
+
+		updated, err := s.client.Secrets(s.namespace).Update(secret)
+		if err == nil {
+			s.secret = updated
+			return true, nil
+		}
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		log.Infof("Could not update the secret %s: %s", s.name, err)
+		return false, err
+	})
+	return combineErrors(append(txn.errs, fnErr, casErr))
+}
+
+// Schemas returns the JSON schema currently validated against for each metric kind.
+func (s *secretStore) Schemas() map[string]string {
+	return defaultSchemaRegistry.Schemas()
+}
+
+// ListAllExternalMetricValues returns the most up-to-date list of external metrics from the secret.
+// Any replica can safely call this function.
+func (s *secretStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
+	if err := s.getSecret(); err != nil {
+		return nil, err
+	}
+	var metrics []ExternalMetricValue
+	for _, v := range s.secret.Data {
+		entry, ok := decodeStoredEntry(string(v), labels.SelectorFromSet(labels.Set{labelKind: kindExternal}))
+		if !ok {
+			continue
+		}
+		m := ExternalMetricValue{}
+		if err := json.Unmarshal(entry.Payload, &m); err != nil {
+			log.Debugf("Could not unmarshal the external metric: %s", err)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func (s *secretStore) ListAllPodsMetrics() ([]PodsMetricDescriptor, error) {
+	if err := s.getSecret(); err != nil {
+		return nil, err
+	}
+	var descs []PodsMetricDescriptor
+	for _, v := range s.secret.Data {
+		entry, ok := decodeStoredEntry(string(v), labels.SelectorFromSet(labels.Set{labelKind: kindPods}))
+		if !ok {
+			continue
+		}
+		desc := PodsMetricDescriptor{}
+		if err := json.Unmarshal(entry.Payload, &desc); err != nil {
+			log.Debugf("Could not unmarshal the pods metric descriptor: %s", err)
+			continue
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+func (s *secretStore) ListAllObjectMetrics() ([]ObjectMetricDescriptor, error) {
+	if err := s.getSecret(); err != nil {
+		return nil, err
+	}
+	var descs []ObjectMetricDescriptor
+	for _, v := range s.secret.Data {
+		entry, ok := decodeStoredEntry(string(v), labels.SelectorFromSet(labels.Set{labelKind: kindObject}))
+		if !ok {
+			continue
+		}
+		desc := ObjectMetricDescriptor{}
+		if err := json.Unmarshal(entry.Payload, &desc); err != nil {
+			log.Debugf("Could not unmarshal the object metric descriptor: %s", err)
+			continue
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+// ListByHPA resolves every metric stored for a single HPA in one labeled pass over the
+// secret, instead of scanning and string-splitting every key.
+func (s *secretStore) ListByHPA(namespace, name string) (HPAMetrics, error) {
+	return s.ListByLabels(hpaSelector(namespace, name))
+}
+
+// ListByLabels returns every metric whose indexing metadata matches selector.
+func (s *secretStore) ListByLabels(selector labels.Selector) (HPAMetrics, error) {
+	if err := s.getSecret(); err != nil {
+		return HPAMetrics{}, err
+	}
+	var out HPAMetrics
+	for _, v := range s.secret.Data {
+		entry, ok := decodeStoredEntry(string(v), selector)
+		if !ok {
+			continue
+		}
+		switch entry.Meta.Kind {
+		case kindExternal:
+			m := ExternalMetricValue{}
+			if err := json.Unmarshal(entry.Payload, &m); err == nil {
+				out.External = append(out.External, m)
+			}
+		case kindPods:
+			desc := PodsMetricDescriptor{}
+			if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+				out.Pods = append(out.Pods, desc)
+			}
+		case kindObject:
+			desc := ObjectMetricDescriptor{}
+			if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+				out.Object = append(out.Object, desc)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s *secretStore) getSecret() error {
+	var err error
+	s.secret, err = s.client.Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	if err != nil {
+		log.Infof("Could not get the secret %s: %s", s.name, err)
+		return err
+	}
+	migrateLegacySecretKeys(s.secret)
+	return nil
+}
+
+// migrateLegacySecretKeys is the Secret-store counterpart of migrateLegacyConfigMapKeys: it
+// rewrites entries still using the pre-label key scheme into the current labeled storedEntry
+// format, the first time they're read after an upgrade.
+func migrateLegacySecretKeys(secret *v1.Secret) {
+	legacy := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		var probe storedEntry
+		if json.Unmarshal(v, &probe) == nil && probe.Meta.Kind != "" {
+			continue // already migrated
+		}
+		legacy[k] = string(v)
+	}
+	if len(legacy) == 0 {
+		return
+	}
+
+	tmp := &v1.ConfigMap{Data: legacy}
+	migrateLegacyConfigMapKeys(tmp)
+
+	for k := range legacy {
+		delete(secret.Data, k)
+	}
+	for k, v := range tmp.Data {
+		secret.Data[k] = []byte(v)
+	}
+}
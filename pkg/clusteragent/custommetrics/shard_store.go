@@ -0,0 +1,361 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	defaultNumShards          = 16
+	defaultMaxEntriesPerShard = 1000
+
+	// labelManagedBy marks every shard ConfigMap so they can all be discovered with a single
+	// labeled List call.
+	labelManagedBy  = "app.kubernetes.io/managed-by"
+	managedByValue  = "datadog-cluster-agent"
+	labelShardIndex = "metrics.datadoghq.com/shard"
+)
+
+// shardedConfigMapStore spreads custom and external metrics across N ConfigMaps instead of
+// one, to stay clear of etcd's ~1MB object size limit in clusters with many HPAs. Each entry
+// is assigned to a shard by hashing HPA.UID + MetricName, so a given metric always lands on
+// the same shard for as long as numShards doesn't change.
+type shardedConfigMapStore struct {
+	namespace          string
+	baseName           string
+	numShards          int
+	maxEntriesPerShard int
+	client             corev1.CoreV1Interface
+}
+
+// NewShardedConfigMapStore returns a new store that spreads metrics across
+// `external_metrics_provider.num_shards` ConfigMaps (default 16) named "<name>-shard-<i>".
+// Shards are created lazily on first write.
+func NewShardedConfigMapStore(client kubernetes.Interface, ns, name string) (Store, error) {
+	numShards := config.Datadog.GetInt("external_metrics_provider.num_shards")
+	if numShards <= 0 {
+		numShards = defaultNumShards
+	}
+	maxEntriesPerShard := config.Datadog.GetInt("external_metrics_provider.max_entries_per_shard")
+	if maxEntriesPerShard <= 0 {
+		maxEntriesPerShard = defaultMaxEntriesPerShard
+	}
+	return &shardedConfigMapStore{
+		namespace:          ns,
+		baseName:           name,
+		numShards:          numShards,
+		maxEntriesPerShard: maxEntriesPerShard,
+		client:             client.CoreV1(),
+	}, nil
+}
+
+func (s *shardedConfigMapStore) SetExternalMetricValues(added []ExternalMetricValue) error {
+	byShard := make(map[int][]func(*v1.ConfigMap) error)
+	var errs []error
+	for _, m := range added {
+		m := m
+		if err := validateEntry(kindExternal, m); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindExternal, m.HPA, m.MetricName)
+		idx := s.shardIndex(meta.HPAUID, m.MetricName)
+		byShard[idx] = append(byShard[idx], func(cm *v1.ConfigMap) error { return setEntry(cm, meta, m) })
+	}
+	errs = append(errs, s.applyToShards(byShard))
+	return combineErrors(errs)
+}
+
+func (s *shardedConfigMapStore) SetPodsMetrics(descs []PodsMetricDescriptor) error {
+	byShard := make(map[int][]func(*v1.ConfigMap) error)
+	var errs []error
+	for _, desc := range descs {
+		desc := desc
+		if err := validateEntry(kindPods, desc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindPods, desc.HPA, desc.MetricName)
+		idx := s.shardIndex(meta.HPAUID, desc.MetricName)
+		byShard[idx] = append(byShard[idx], func(cm *v1.ConfigMap) error { return setEntry(cm, meta, desc) })
+	}
+	errs = append(errs, s.applyToShards(byShard))
+	return combineErrors(errs)
+}
+
+func (s *shardedConfigMapStore) SetObjectMetrics(descs []ObjectMetricDescriptor) error {
+	byShard := make(map[int][]func(*v1.ConfigMap) error)
+	var errs []error
+	for _, desc := range descs {
+		desc := desc
+		if err := validateEntry(kindObject, desc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		meta := metadataFor(kindObject, desc.HPA, desc.MetricName)
+		idx := s.shardIndex(meta.HPAUID, desc.MetricName)
+		byShard[idx] = append(byShard[idx], func(cm *v1.ConfigMap) error { return setEntry(cm, meta, desc) })
+	}
+	errs = append(errs, s.applyToShards(byShard))
+	return combineErrors(errs)
+}
+
+// applyToShards fetches (or creates) only the shards that have pending writes, applies them,
+// and Update()s only those shards -- every shard without a pending write is left untouched. Each shard is
+// updated through its own withCAS loop, since two Cluster Agent replicas can race on the same
+// shard even though they're writing disjoint entries.
+func (s *shardedConfigMapStore) applyToShards(byShard map[int][]func(*v1.ConfigMap) error) error {
+	var errs []error
+	for idx, writes := range byShard {
+		if err := s.applyToShard(idx, writes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+func (s *shardedConfigMapStore) applyToShard(idx int, writes []func(*v1.ConfigMap) error) error {
+	return withCAS(func() (bool, error) {
+		cm, err := s.getOrCreateShard(idx)
+		if err != nil {
+			return false, err
+		}
+		for _, write := range writes {
+			if err := write(cm); err != nil {
+				log.Debugf("Could not write an entry to shard %d of %s: %s", idx, s.baseName, err)
+			}
+		}
+		if len(cm.Data) > s.maxEntriesPerShard {
+			return false, fmt.Errorf("shard %d of %s has %d entries, over the %d limit: increase external_metrics_provider.num_shards",
+				idx, s.baseName, len(cm.Data), s.maxEntriesPerShard)
+		}
+		if _, err := s.client.ConfigMaps(s.namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				return false, nil
+			}
+			log.Infof("Could not update shard %d of %s: %s", idx, s.baseName, err)
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Delete deletes all metrics referring to any of the given object references, across every
+// shard. Every deleted object is matched against a shard's entries in the single listShards()
+// List, so no extra Get is needed unless a shard's Update() hits a resourceVersion conflict.
+// Only shards that actually had an entry removed are Update()d.
+func (s *shardedConfigMapStore) Delete(deleted []ObjectReference) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	selectors := make([]labels.Selector, len(deleted))
+	for i, obj := range deleted {
+		selectors[i] = hpaUIDSelector(obj.UID)
+	}
+	shards, err := s.listShards()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, cm := range shards {
+		if err := s.deleteFromShard(cm, selectors); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// deleteFromShard removes every entry of cm.Data matching any of selectors. The first attempt
+// reuses cm as already fetched by listShards(); only a retry after a resourceVersion conflict
+// re-Gets the shard.
+func (s *shardedConfigMapStore) deleteFromShard(cm *v1.ConfigMap, selectors []labels.Selector) error {
+	name := cm.Name
+	fetched := false
+	return withCAS(func() (bool, error) {
+		if fetched {
+			var err error
+			cm, err = s.client.ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				if errors.IsNotFound(err) {
+					return true, nil
+				}
+				return false, err
+			}
+		}
+		fetched = true
+		changed := false
+		for k, v := range cm.Data {
+			for _, selector := range selectors {
+				if _, ok := decodeStoredEntry(v, selector); ok {
+					delete(cm.Data, k)
+					changed = true
+					break
+				}
+			}
+		}
+		if !changed {
+			return true, nil
+		}
+		if _, err := s.client.ConfigMaps(s.namespace).Update(cm); err != nil {
+			if errors.IsConflict(err) {
+				return false, nil
+			}
+			log.Infof("Could not update shard %s while deleting metrics: %s", name, err)
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Transaction replays fn's mutations sequentially: a transaction can span multiple shards, so
+// unlike configMapStore and secretStore it can't be folded into a single object's CAS attempt.
+// txn.errs is combined into the result alongside any replay error, same as every other Store
+// driver.
+func (s *shardedConfigMapStore) Transaction(fn func(tx Transaction) error) error {
+	txn := &pendingTransaction{}
+	fnErr := fn(txn)
+	replayErr := txn.replayAll(s)
+	return combineErrors(append(txn.errs, fnErr, replayErr))
+}
+
+// Schemas returns the JSON schema currently validated against for each metric kind.
+func (s *shardedConfigMapStore) Schemas() map[string]string {
+	return defaultSchemaRegistry.Schemas()
+}
+
+func (s *shardedConfigMapStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
+	out, err := s.ListByLabels(labels.SelectorFromSet(labels.Set{labelOwner: ownerDatadogAgent, labelKind: kindExternal}))
+	return out.External, err
+}
+
+func (s *shardedConfigMapStore) ListAllPodsMetrics() ([]PodsMetricDescriptor, error) {
+	out, err := s.ListByLabels(labels.SelectorFromSet(labels.Set{labelOwner: ownerDatadogAgent, labelKind: kindPods}))
+	return out.Pods, err
+}
+
+func (s *shardedConfigMapStore) ListAllObjectMetrics() ([]ObjectMetricDescriptor, error) {
+	out, err := s.ListByLabels(labels.SelectorFromSet(labels.Set{labelOwner: ownerDatadogAgent, labelKind: kindObject}))
+	return out.Object, err
+}
+
+// ListByHPA fans out across every shard and merges the results.
+func (s *shardedConfigMapStore) ListByHPA(namespace, name string) (HPAMetrics, error) {
+	return s.ListByLabels(hpaSelector(namespace, name))
+}
+
+// ListByLabels fans out across every shard and merges the results.
+func (s *shardedConfigMapStore) ListByLabels(selector labels.Selector) (HPAMetrics, error) {
+	shards, err := s.listShards()
+	if err != nil {
+		return HPAMetrics{}, err
+	}
+	var out HPAMetrics
+	for _, cm := range shards {
+		for _, v := range cm.Data {
+			entry, ok := decodeStoredEntry(v, selector)
+			if !ok {
+				continue
+			}
+			switch entry.Meta.Kind {
+			case kindExternal:
+				m := ExternalMetricValue{}
+				if err := json.Unmarshal(entry.Payload, &m); err == nil {
+					out.External = append(out.External, m)
+				}
+			case kindPods:
+				desc := PodsMetricDescriptor{}
+				if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+					out.Pods = append(out.Pods, desc)
+				}
+			case kindObject:
+				desc := ObjectMetricDescriptor{}
+				if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+					out.Object = append(out.Object, desc)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// listShards discovers every shard ConfigMap via the shared managed-by label, rather than
+// assuming s.numShards still matches what was used when the shards were created.
+func (s *shardedConfigMapStore) listShards() ([]*v1.ConfigMap, error) {
+	list, err := s.client.ConfigMaps(s.namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelManagedBy: managedByValue, labelOwner: ownerDatadogAgent}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*v1.ConfigMap, 0, len(list.Items))
+	for i := range list.Items {
+		shards = append(shards, &list.Items[i])
+	}
+	return shards, nil
+}
+
+func (s *shardedConfigMapStore) getOrCreateShard(idx int) (*v1.ConfigMap, error) {
+	name := s.shardName(idx)
+	cm, err := s.client.ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	cm = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				labelManagedBy:  managedByValue,
+				labelOwner:      ownerDatadogAgent,
+				labelShardIndex: fmt.Sprintf("%d", idx),
+			},
+		},
+	}
+	return s.client.ConfigMaps(s.namespace).Create(cm)
+}
+
+func (s *shardedConfigMapStore) shardName(idx int) string {
+	return fmt.Sprintf("%s-shard-%d", s.baseName, idx)
+}
+
+// shardIndex assigns a (HPA UID, metric name) pair to a shard. It must be a pure function of
+// its inputs and numShards so that the same metric always resolves to the same shard between
+// calls, independent of map iteration order.
+func (s *shardedConfigMapStore) shardIndex(hpaUID, metricName string) int {
+	sum := sha256.Sum256([]byte(hpaUID + "/" + metricName))
+	h := binary.BigEndian.Uint64(sum[:8])
+	return int(h % uint64(s.numShards))
+}
+
+func setEntry(cm *v1.ConfigMap, meta entryMetadata, obj interface{}) error {
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	toStore, err := marshalEntry(meta, obj)
+	if err != nil {
+		return err
+	}
+	cm.Data[entryKey(meta.Kind, meta.HPAUID, meta.MetricNameHash)] = toStore
+	return nil
+}
@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestShardedConfigMapStoreSetAndList(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewShardedConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	var values []ExternalMetricValue
+	for i := 0; i < 50; i++ {
+		values = append(values, ExternalMetricValue{
+			MetricName: fmt.Sprintf("metric-%d", i),
+			Value:      float64(i),
+			HPA:        ObjectReference{UID: fmt.Sprintf("uid-%d", i), Namespace: "default", Name: "my-hpa"},
+		})
+	}
+	require.NoError(t, store.SetExternalMetricValues(values))
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.Len(t, metrics, 50)
+
+	cms, err := client.CoreV1().ConfigMaps("default").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.True(t, len(cms.Items) > 1, "entries should be spread across more than one shard")
+}
+
+func TestShardedConfigMapStoreDelete(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewShardedConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	ref := ObjectReference{UID: "uid-1", Namespace: "default", Name: "my-hpa"}
+	require.NoError(t, store.SetPodsMetrics([]PodsMetricDescriptor{{MetricName: "queue_depth", HPA: ref}}))
+
+	require.NoError(t, store.Delete([]ObjectReference{ref}))
+
+	descs, err := store.ListAllPodsMetrics()
+	require.NoError(t, err)
+	assert.Empty(t, descs)
+}
+
+func TestShardedConfigMapStoreMaxEntriesPerShard(t *testing.T) {
+	config.Datadog.Set("external_metrics_provider.num_shards", 1)
+	config.Datadog.Set("external_metrics_provider.max_entries_per_shard", 2)
+	defer config.Datadog.Set("external_metrics_provider.num_shards", 0)
+	defer config.Datadog.Set("external_metrics_provider.max_entries_per_shard", 0)
+
+	client := fake.NewSimpleClientset()
+	store, err := NewShardedConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	var values []ExternalMetricValue
+	for i := 0; i < 3; i++ {
+		values = append(values, ExternalMetricValue{
+			MetricName: fmt.Sprintf("metric-%d", i),
+			HPA:        ObjectReference{UID: fmt.Sprintf("uid-%d", i)},
+		})
+	}
+	err = store.SetExternalMetricValues(values)
+	assert.Error(t, err)
+}
+
+func TestShardedConfigMapStoreOneFullShardDoesNotBlockOthers(t *testing.T) {
+	config.Datadog.Set("external_metrics_provider.num_shards", 2)
+	config.Datadog.Set("external_metrics_provider.max_entries_per_shard", 1)
+	defer config.Datadog.Set("external_metrics_provider.num_shards", 0)
+	defer config.Datadog.Set("external_metrics_provider.max_entries_per_shard", 0)
+
+	client := fake.NewSimpleClientset()
+	store, err := NewShardedConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	// uid-0/metric-0 and uid-2/metric-2 both land on shard 1, overflowing its 1-entry limit;
+	// uid-1/metric-1 lands on shard 0 and should still be persisted despite shard 1's failure.
+	err = store.SetExternalMetricValues([]ExternalMetricValue{
+		{MetricName: "metric-0", HPA: ObjectReference{UID: "uid-0"}},
+		{MetricName: "metric-2", HPA: ObjectReference{UID: "uid-2"}},
+		{MetricName: "metric-1", HPA: ObjectReference{UID: "uid-1"}},
+	})
+	require.Error(t, err)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "metric-1", metrics[0].MetricName)
+}
@@ -17,15 +17,32 @@ import (
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 )
 
+// legacyKeyDelimeter was used by the pre-label storage scheme ("value-external-<uid>-<name>").
+// It's kept around only so getConfigMap/getSecret can migrate old entries on first read.
+const legacyKeyDelimeter = "-"
+
 const (
-	keyDelimeter = "-"
+	// storeTypeConfigMap persists metrics in a single ConfigMap. This is the historical, default behavior.
+	storeTypeConfigMap = "configmap"
+	// storeTypeSecret persists metrics in a Secret, for clusters where metric values are considered sensitive
+	// or where RBAC only grants access to Secrets.
+	storeTypeSecret = "secret"
+	// storeTypeCustomResource persists each metric as its own DatadogMetric custom resource.
+	storeTypeCustomResource = "crd"
+	// storeTypeShardedConfigMap spreads metrics across several ConfigMaps to avoid the single
+	// ConfigMap driver's exposure to etcd's ~1MB object size limit in large clusters.
+	storeTypeShardedConfigMap = "configmap-sharded"
 )
 
-// Store is an interface for persistent storage of custom and external metrics.
+// Store is an interface for persistent storage of custom and external metrics. It's a thin,
+// swappable persistence backend: callers (the HPA controller, the external metrics provider)
+// never need to know which driver is in use.
 type Store interface {
 	SetExternalMetricValues([]ExternalMetricValue) error
 	SetPodsMetrics([]PodsMetricDescriptor) error
@@ -36,6 +53,54 @@ type Store interface {
 	ListAllExternalMetricValues() ([]ExternalMetricValue, error)
 	ListAllPodsMetrics() ([]PodsMetricDescriptor, error)
 	ListAllObjectMetrics() ([]ObjectMetricDescriptor, error)
+
+	// ListByHPA returns every metric of every kind stored for a single HPA, resolved in one
+	// labeled lookup instead of scanning and parsing every stored key.
+	ListByHPA(namespace, name string) (HPAMetrics, error)
+	// ListByLabels returns every metric whose indexing metadata matches selector.
+	ListByLabels(selector labels.Selector) (HPAMetrics, error)
+
+	// Transaction batches the Set*/Delete calls made by fn. The configmap and secret drivers
+	// apply them in a single read-modify-write/CAS attempt; the sharded configmap and crd
+	// drivers replay them one call at a time.
+	Transaction(fn func(tx Transaction) error) error
+
+	// Schemas returns the JSON schema every Set* call is currently validated against, keyed by
+	// metric kind, so the external metrics API server can advertise them to clients.
+	Schemas() map[string]string
+}
+
+// GetHPAConfigmapName returns the name of the ConfigMap used to store the state of the Custom Metrics Provider
+func GetHPAConfigmapName() string {
+	return config.Datadog.GetString("hpa_configmap_name")
+}
+
+// NewStore returns a Store backed by the driver configured via
+// `external_metrics_provider.store_type` (defaults to "configmap"). All drivers share the
+// same Store interface so callers don't need to special-case the backend in use. `cfg` is
+// only used by the "crd" driver, which needs its own REST client scoped to the DatadogMetric
+// CRD's GroupVersion; it may be nil for the other drivers.
+func NewStore(client kubernetes.Interface, cfg *rest.Config, ns, name string) (Store, error) {
+	schemaConfigMapName := config.Datadog.GetString("external_metrics_provider.schema_configmap_name")
+	if schemaConfigMapName == "" {
+		schemaConfigMapName = defaultSchemaConfigMapName
+	}
+	if err := ApplySchemaOverrides(client, ns, schemaConfigMapName); err != nil {
+		return nil, err
+	}
+
+	switch storeType := config.Datadog.GetString("external_metrics_provider.store_type"); storeType {
+	case "", storeTypeConfigMap:
+		return NewConfigMapStore(client, ns, name)
+	case storeTypeSecret:
+		return NewSecretStore(client, ns, name)
+	case storeTypeShardedConfigMap:
+		return NewShardedConfigMapStore(client, ns, name)
+	case storeTypeCustomResource:
+		return NewCustomResourceStore(cfg, ns)
+	default:
+		return nil, fmt.Errorf("unknown external_metrics_provider.store_type %q", storeType)
+	}
 }
 
 // configMapStore provides persistent storage of custom and external metrics using a configmap.
@@ -46,11 +111,6 @@ type configMapStore struct {
 	cm        *v1.ConfigMap
 }
 
-// GetHPAConfigmapName returns the name of the ConfigMap used to store the state of the Custom Metrics Provider
-func GetHPAConfigmapName() string {
-	return config.Datadog.GetString("hpa_configmap_name")
-}
-
 // NewConfigMapStore returns a new store backed by a configmap. The configmap will be created
 // in the specified namespace if it does not exist.
 func NewConfigMapStore(client kubernetes.Interface, ns, name string) (Store, error) {
@@ -75,6 +135,7 @@ func NewConfigMapStore(client kubernetes.Interface, ns, name string) (Store, err
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: ns,
+			Labels:    map[string]string{labelOwner: ownerDatadogAgent},
 		},
 	}
 	// FIXME: distinguish RBAC error
@@ -92,92 +153,79 @@ func NewConfigMapStore(client kubernetes.Interface, ns, name string) (Store, err
 
 // SetExternalMetricValues updates the external metrics in the configmap.
 func (c *configMapStore) SetExternalMetricValues(added []ExternalMetricValue) error {
-	if len(added) == 0 {
-		return nil
-	}
-	for _, m := range added {
-		key := strings.Join([]string{"value", "external", m.HPA.UID, m.MetricName}, keyDelimeter)
-		if err := c.set(key, desc); err == nil {
-			continue
-		}
-		log.Debugf("Could not marshal the external metric %v: %s", m, err)
-	}
-	return c.updateConfigMap()
+	return c.Transaction(func(tx Transaction) error { return tx.SetExternalMetricValues(added) })
 }
 
 func (c *configMapStore) SetPodsMetrics(descs []PodsMetricDescriptor) error {
-	if len(descs) == 0 {
-		return nil
-	}
-	for _, desc := range descs {
-		key := strings.Join([]string{"metric", "pods", m.HPA.UID, m.MetricName}, keyDelimeter)
-		if err := c.set(key, desc); err == nil {
-			continue
-		}
-		log.Debugf("Could not marshal the pods metric descriptor %v: %s", m, err)
-	}
-	return c.updateConfigMap()
+	return c.Transaction(func(tx Transaction) error { return tx.SetPodsMetrics(descs) })
 }
 
 func (c *configMapStore) SetObjectMetrics(descs []ObjectMetricDescriptor) error {
-	if len(descs) == 0 {
-		return nil
-	}
-	for _, desc := range descs {
-		key := strings.Join([]string{"metric", "object", m.HPA.UID, m.MetricName}, keyDelimeter)
-		if err := c.set(key, desc); err == nil {
-			continue
-		}
-		log.Debugf("Could not marshal the object metric descriptor %v: %s", m, err)
-	}
-	return c.updateConfigMap()
+	return c.Transaction(func(tx Transaction) error { return tx.SetObjectMetrics(descs) })
 }
 
 // Delete deletes all metrics in the configmap that refer to any of the given object references.
 func (c *configMapStore) Delete(deleted []ObjectReference) error {
-	if c.cm == nil {
-		return fmt.Errorf("configmap not initialized")
-	}
-	if len(deleted) == 0 {
-		return nil
+	return c.Transaction(func(tx Transaction) error { return tx.Delete(deleted) })
+}
+
+// Transaction performs fn's mutations as a single read-modify-write cycle: it GETs the
+// configmap to capture its resourceVersion, applies every queued mutation to a copy, and
+// Update()s it. On a resourceVersion conflict (another Cluster Agent replica, or the HPA
+// controller, updated the configmap first) it re-reads and retries with exponential backoff.
+// txn.errs (entries pendingTransaction rejected at queue time) is combined into the result
+// alongside any CAS error, so a schema rejection never hides whether the rest of the batch
+// also failed or succeeded.
+func (c *configMapStore) Transaction(fn func(tx Transaction) error) error {
+	txn := &pendingTransaction{}
+	fnErr := fn(txn)
+	if len(txn.ops) == 0 {
+		return combineErrors(append(txn.errs, fnErr))
 	}
-	for _, obj := range deleted {
-		// Delete all metrics from the configmap that reference this object.
-		for k := range c.cm.Data {
-			parts := strings.Split(k, keyDelimeter)
-			if len(parts) < 4 {
-				log.Debugf("Deleting malformed key %s", k)
-				delete(c.cm.Data, k)
-				continue
-			}
-			if parts[2] != obj.UID {
-				continue
-			}
-			delete(c.cm.Data, k)
-			log.Debugf("Deleted metric %s for HPA %s from the configmap %s", parts[3], obj.Name, c.name)
+	casErr := withCAS(func() (bool, error) {
+		if err := c.getConfigMap(); err != nil {
+			return false, err
 		}
-	}
-	return c.updateConfigMap()
+		cm := c.cm.DeepCopy()
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		txn.applyAll(cm.Data)
+
+		updated, err := c.client.ConfigMaps(c.namespace).Update(cm)
+		if err == nil {
+			c.cm = updated
+			return true, nil
+		}
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		log.Infof("Could not update the configmap %s: %s", c.name, err)
+		return false, err
+	})
+	return combineErrors(append(txn.errs, fnErr, casErr))
+}
+
+// Schemas returns the JSON schema currently validated against for each metric kind.
+func (c *configMapStore) Schemas() map[string]string {
+	return defaultSchemaRegistry.Schemas()
 }
 
 // ListAllExternalMetricValues returns the most up-to-date list of external metrics from the configmap.
 // Any replica can safely call this function.
 func (c *configMapStore) ListAllExternalMetricValues() ([]ExternalMetricValue, error) {
-	var metrics []ExternalMetricValue
 	if err := c.getConfigMap(); err != nil {
 		return nil, err
 	}
-	for k, v := range c.cm.Data {
-		parts := strings.Split(k, keyDelimeter)
-		if len(parts) < 4 {
-			continue
-		}
-		if parts[0] != "value" && parts[1] != "external" {
+	var metrics []ExternalMetricValue
+	for _, v := range c.cm.Data {
+		entry, ok := decodeStoredEntry(v, labels.SelectorFromSet(labels.Set{labelKind: kindExternal}))
+		if !ok {
 			continue
 		}
 		m := ExternalMetricValue{}
-		if err := json.Unmarshal([]byte(v), &m); err != nil {
-			log.Debugf("Could not unmarshal the external metric for key %s: %s", k, err)
+		if err := json.Unmarshal(entry.Payload, &m); err != nil {
+			log.Debugf("Could not unmarshal the external metric: %s", err)
 			continue
 		}
 		metrics = append(metrics, m)
@@ -186,21 +234,18 @@ func (c *configMapStore) ListAllExternalMetricValues() ([]ExternalMetricValue, e
 }
 
 func (c *configMapStore) ListAllPodsMetrics() ([]PodsMetricDescriptor, error) {
-	if c.cm == nil {
-		return fmt.Errorf("configmap not initialized")
+	if err := c.getConfigMap(); err != nil {
+		return nil, err
 	}
 	var descs []PodsMetricDescriptor
-	for k, v := range c.cm.Data {
-		parts := strings.Split(k, keyDelimeter)
-		if len(parts) < 4 {
-			continue
-		}
-		if parts[0] != "metric" && parts[1] != "pods" {
+	for _, v := range c.cm.Data {
+		entry, ok := decodeStoredEntry(v, labels.SelectorFromSet(labels.Set{labelKind: kindPods}))
+		if !ok {
 			continue
 		}
 		desc := PodsMetricDescriptor{}
-		if err := json.Unmarshal([]byte(v), &desc); err != nil {
-			log.Debugf("Could not unmarshal the pods metric descriptor for key %s: %s", k, err)
+		if err := json.Unmarshal(entry.Payload, &desc); err != nil {
+			log.Debugf("Could not unmarshal the pods metric descriptor: %s", err)
 			continue
 		}
 		descs = append(descs, desc)
@@ -209,20 +254,18 @@ func (c *configMapStore) ListAllPodsMetrics() ([]PodsMetricDescriptor, error) {
 }
 
 func (c *configMapStore) ListAllObjectMetrics() ([]ObjectMetricDescriptor, error) {
-	if c.cm == nil {
-		return fmt.Errorf("configmap not initialized")
+	if err := c.getConfigMap(); err != nil {
+		return nil, err
 	}
 	var descs []ObjectMetricDescriptor
-	for k, v := range c.cm.Data {
-		if len(parts) < 4 {
-			continue
-		}
-		if parts[0] != "metric" && parts[1] != "object" {
+	for _, v := range c.cm.Data {
+		entry, ok := decodeStoredEntry(v, labels.SelectorFromSet(labels.Set{labelKind: kindObject}))
+		if !ok {
 			continue
 		}
 		desc := ObjectMetricDescriptor{}
-		if err := json.Unmarshal([]byte(v), &desc); err != nil {
-			log.Debugf("Could not unmarshal the object metric descriptor for key %s: %s", k, err)
+		if err := json.Unmarshal(entry.Payload, &desc); err != nil {
+			log.Debugf("Could not unmarshal the object metric descriptor: %s", err)
 			continue
 		}
 		descs = append(descs, desc)
@@ -230,20 +273,42 @@ func (c *configMapStore) ListAllObjectMetrics() ([]ObjectMetricDescriptor, error
 	return descs, nil
 }
 
-func (c *configMapStore) set(key, obj interface{}) error {
-	if c.cm == nil {
-		return fmt.Errorf("configmap not initialized")
-	}
-	if c.cm.Data == nil {
-		// Don't panic "assignment to entry in nil map" at init
-		c.cm.Data = make(map[string]string)
+// ListByHPA resolves every metric stored for a single HPA in one labeled pass over the
+// configmap, instead of scanning and string-splitting every key.
+func (c *configMapStore) ListByHPA(namespace, name string) (HPAMetrics, error) {
+	return c.ListByLabels(hpaSelector(namespace, name))
+}
+
+// ListByLabels returns every metric whose indexing metadata matches selector.
+func (c *configMapStore) ListByLabels(selector labels.Selector) (HPAMetrics, error) {
+	if err := c.getConfigMap(); err != nil {
+		return HPAMetrics{}, err
 	}
-	toStore, err := json.Marshal(obj)
-	if err != nil {
-		return err
+	var out HPAMetrics
+	for _, v := range c.cm.Data {
+		entry, ok := decodeStoredEntry(v, selector)
+		if !ok {
+			continue
+		}
+		switch entry.Meta.Kind {
+		case kindExternal:
+			m := ExternalMetricValue{}
+			if err := json.Unmarshal(entry.Payload, &m); err == nil {
+				out.External = append(out.External, m)
+			}
+		case kindPods:
+			desc := PodsMetricDescriptor{}
+			if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+				out.Pods = append(out.Pods, desc)
+			}
+		case kindObject:
+			desc := ObjectMetricDescriptor{}
+			if err := json.Unmarshal(entry.Payload, &desc); err == nil {
+				out.Object = append(out.Object, desc)
+			}
+		}
 	}
-	c.cm.Data[key] = string(toStore)
-	return nil
+	return out, nil
 }
 
 func (c *configMapStore) getConfigMap() error {
@@ -253,18 +318,64 @@ func (c *configMapStore) getConfigMap() error {
 		log.Infof("Could not get the configmap %s: %s", c.name, err)
 		return err
 	}
+	migrateLegacyConfigMapKeys(c.cm)
 	return nil
 }
 
-func (c *configMapStore) updateConfigMap() error {
-	if c.cm == nil {
-		return fmt.Errorf("configmap not initialized")
-	}
-	var err error
-	c.cm, err = c.client.ConfigMaps(c.namespace).Update(c.cm)
-	if err != nil {
-		log.Infof("Could not update the configmap %s: %s", c.name, err)
-		return err
+// migrateLegacyConfigMapKeys rewrites entries still using the pre-label
+// "<value|metric>-<kind>-<uid>-<name>" key scheme into the current labeled storedEntry
+// format, the first time they're read after an upgrade.
+func migrateLegacyConfigMapKeys(cm *v1.ConfigMap) {
+	for k, v := range cm.Data {
+		var probe storedEntry
+		if json.Unmarshal([]byte(v), &probe) == nil && probe.Meta.Kind != "" {
+			continue // already migrated
+		}
+		parts := strings.Split(k, legacyKeyDelimeter)
+		if len(parts) < 4 {
+			log.Debugf("Dropping unrecognized configmap key %s during migration", k)
+			delete(cm.Data, k)
+			continue
+		}
+		kind := parts[1]
+		hpaUID, metricName := parts[2], parts[3]
+		var meta entryMetadata
+		var payload json.RawMessage
+		switch kind {
+		case "external":
+			m := ExternalMetricValue{}
+			if json.Unmarshal([]byte(v), &m) != nil {
+				delete(cm.Data, k)
+				continue
+			}
+			meta = metadataFor(kindExternal, m.HPA, m.MetricName)
+			payload, _ = json.Marshal(m)
+		case "pods":
+			desc := PodsMetricDescriptor{}
+			if json.Unmarshal([]byte(v), &desc) != nil {
+				delete(cm.Data, k)
+				continue
+			}
+			meta = metadataFor(kindPods, desc.HPA, desc.MetricName)
+			payload, _ = json.Marshal(desc)
+		case "object":
+			desc := ObjectMetricDescriptor{}
+			if json.Unmarshal([]byte(v), &desc) != nil {
+				delete(cm.Data, k)
+				continue
+			}
+			meta = metadataFor(kindObject, desc.HPA, desc.MetricName)
+			payload, _ = json.Marshal(desc)
+		default:
+			meta = entryMetadata{Kind: kind, HPAUID: hpaUID, MetricNameHash: hashMetricName(metricName)}
+			payload = json.RawMessage(v)
+		}
+		toStore, err := json.Marshal(storedEntry{Meta: meta, Payload: payload})
+		if err != nil {
+			continue
+		}
+		delete(cm.Data, k)
+		cm.Data[entryKey(meta.Kind, meta.HPAUID, meta.MetricNameHash)] = string(toStore)
+		log.Debugf("Migrated legacy configmap key %s to the labeled storage scheme", k)
 	}
-	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,111 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStoreSetAndList(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	err = store.SetExternalMetricValues([]ExternalMetricValue{
+		{MetricName: "requests_per_second", Value: 42, HPA: ObjectReference{UID: "uid-1", Namespace: "default", Name: "my-hpa"}},
+	})
+	require.NoError(t, err)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "requests_per_second", metrics[0].MetricName)
+	assert.Equal(t, "uid-1", metrics[0].HPA.UID)
+}
+
+func TestSecretStoreSetAndList(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewSecretStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	err = store.SetPodsMetrics([]PodsMetricDescriptor{
+		{MetricName: "queue_depth", HPA: ObjectReference{UID: "uid-2", Namespace: "default", Name: "other-hpa"}},
+	})
+	require.NoError(t, err)
+
+	descs, err := store.ListAllPodsMetrics()
+	require.NoError(t, err)
+	require.Len(t, descs, 1)
+	assert.Equal(t, "queue_depth", descs[0].MetricName)
+}
+
+func TestSecretStoreDelete(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewSecretStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	ref := ObjectReference{UID: "uid-3", Namespace: "default", Name: "my-hpa"}
+	require.NoError(t, store.SetObjectMetrics([]ObjectMetricDescriptor{{MetricName: "backlog", HPA: ref}}))
+
+	require.NoError(t, store.Delete([]ObjectReference{ref}))
+
+	descs, err := store.ListAllObjectMetrics()
+	require.NoError(t, err)
+	assert.Empty(t, descs)
+}
+
+func TestConfigMapStoreListByHPA(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	ref := ObjectReference{UID: "uid-4", Namespace: "default", Name: "my-hpa"}
+	other := ObjectReference{UID: "uid-5", Namespace: "default", Name: "other-hpa"}
+	require.NoError(t, store.SetExternalMetricValues([]ExternalMetricValue{{MetricName: "rps", Value: 1, HPA: ref}}))
+	require.NoError(t, store.SetPodsMetrics([]PodsMetricDescriptor{{MetricName: "queue_depth", HPA: ref}}))
+	require.NoError(t, store.SetObjectMetrics([]ObjectMetricDescriptor{{MetricName: "backlog", HPA: other}}))
+
+	got, err := store.ListByHPA("default", "my-hpa")
+	require.NoError(t, err)
+	assert.Len(t, got.External, 1)
+	assert.Len(t, got.Pods, 1)
+	assert.Empty(t, got.Object)
+}
+
+func TestConfigMapStoreMigratesLegacyKeys(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store, err := NewConfigMapStore(client, "default", "datadog-custom-metrics")
+	require.NoError(t, err)
+
+	cms, ok := store.(*configMapStore)
+	require.True(t, ok)
+	legacy, err := json.Marshal(ExternalMetricValue{MetricName: "rps", Value: 7, HPA: ObjectReference{UID: "uid-6", Name: "legacy-hpa"}})
+	require.NoError(t, err)
+	cms.cm.Data = map[string]string{"value-external-uid-6-rps": string(legacy)}
+	_, err = client.CoreV1().ConfigMaps("default").Update(cms.cm)
+	require.NoError(t, err)
+
+	metrics, err := store.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "rps", metrics[0].MetricName)
+}
+
+func TestNewStoreUnknownType(t *testing.T) {
+	config.Datadog.Set("external_metrics_provider.store_type", "bogus")
+	defer config.Datadog.Set("external_metrics_provider.store_type", "")
+
+	_, err := NewStore(fake.NewSimpleClientset(), nil, "default", "datadog-custom-metrics")
+	assert.Error(t, err)
+}